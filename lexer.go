@@ -1,6 +1,14 @@
 package buffer // import "github.com/tdewolff/buffer"
 
-import "io"
+import (
+	"errors"
+	"io"
+	"sync"
+	"unicode/utf8"
+)
+
+// errUnreadRune is returned by UnreadRune when the preceding call was not a successful ReadRune.
+var errUnreadRune = errors.New("buffer: UnreadRune: previous operation was not a successful ReadRune")
 
 type block struct {
 	buf    []byte
@@ -8,21 +16,94 @@ type block struct {
 	active bool
 }
 
+// Pool is the interface a Lexer uses to allocate and recycle its internal buffers. Swap
+// returns a new buffer with at least the given capacity, retiring old for later reuse once
+// Free confirms the caller no longer needs it (see BufferPool and NewSyncBufferPool).
+type Pool interface {
+	Swap(old []byte, size int) []byte
+	Free(n int)
+}
+
+// BufferPool recycles the retired buffers of a Lexer. The zero value is an unbounded pool
+// that reuses any freed block regardless of size, found via a linear scan; this is the
+// default used by NewLexer and NewLexerSize. Use NewBufferPool or NewBucketedBufferPool to
+// cap how large a single pooled block may grow. BufferPool is safe for concurrent use, but
+// its retirement accounting models a single underlying stream, so share one instance across
+// several Lexers only if they never run at the same time; for Lexers that run
+// truly in parallel, give each its own NewSyncBufferPool instead.
 type BufferPool struct {
+	mu sync.Mutex
+
 	pool []block
 	head int // index in pool plus one
 	tail int // index in pool plus one
 
 	pos int // byte pos in tail
+
+	maxSize     int     // 0 means unbounded; blocks larger than this are never pooled for reuse
+	minSize     int     // 0 selects the legacy linear scan; >0 enables size-bucketed reuse
+	factor      int     // bucket growth factor, only used when minSize > 0
+	freeBuckets [][]int // freeBuckets[i] holds indices into pool of inactive blocks in bucket i
+}
+
+// NewBufferPool returns a BufferPool that never reuses a freed block larger than maxSize;
+// such blocks are allocated fresh and dropped (not pooled) instead. This keeps a single
+// oversized token from permanently inflating the blocks recycled for every later token.
+// A maxSize of 0 behaves like the zero-value BufferPool: unbounded.
+func NewBufferPool(maxSize int) *BufferPool {
+	return &BufferPool{maxSize: maxSize}
+}
+
+// NewBucketedBufferPool returns a BufferPool that buckets reusable blocks by size class,
+// starting at minSize and growing by factor (e.g. minSize=1024, factor=2 gives buckets of
+// 1KiB, 2KiB, 4KiB, ...) up to maxSize. Blocks larger than maxSize are allocated fresh and
+// dropped rather than pooled. Bucketing lets swap pick a reusable block in its size class
+// instead of scanning every retired block.
+func NewBucketedBufferPool(minSize, maxSize, factor int) *BufferPool {
+	if factor < 2 {
+		factor = 2
+	}
+	return &BufferPool{minSize: minSize, maxSize: maxSize, factor: factor}
+}
+
+// bucket returns the bucket index for size (the smallest bucket whose threshold is >= size)
+// along with that threshold, the size a fresh allocation for this bucket should use.
+func (z *BufferPool) bucket(size int) (idx, threshold int) {
+	threshold = z.minSize
+	for threshold < size {
+		idx++
+		threshold *= z.factor
+	}
+	return idx, threshold
 }
 
 func (z *BufferPool) swap(oldBuf []byte, size int) []byte {
+	oversized := z.maxSize > 0 && size > z.maxSize
+
 	// find new buffer that can be reused
 	swap := -1
-	for i, _ := range z.pool {
-		if !z.pool[i].active && size <= cap(z.pool[i].buf) {
-			swap = i
-			break
+	allocSize := size
+	if !oversized {
+		if z.minSize > 0 {
+			var bucket int
+			bucket, allocSize = z.bucket(size)
+			for i := bucket; i < len(z.freeBuckets) && swap == -1; i++ {
+				for len(z.freeBuckets[i]) > 0 {
+					j := z.freeBuckets[i][len(z.freeBuckets[i])-1]
+					z.freeBuckets[i] = z.freeBuckets[i][:len(z.freeBuckets[i])-1]
+					if size <= cap(z.pool[j].buf) { // a block's cap may be below its bucket's threshold; skip it if it doesn't fit
+						swap = j
+						break
+					}
+				}
+			}
+		} else {
+			for i := range z.pool {
+				if !z.pool[i].active && size <= cap(z.pool[i].buf) {
+					swap = i
+					break
+				}
+			}
 		}
 	}
 	if swap == -1 { // no free buffer found for reuse
@@ -30,7 +111,7 @@ func (z *BufferPool) swap(oldBuf []byte, size int) []byte {
 			z.pos -= len(oldBuf)
 			return oldBuf[:0]
 		} else { // allocate new
-			z.pool = append(z.pool, block{make([]byte, 0, size), 0, true})
+			z.pool = append(z.pool, block{make([]byte, 0, allocSize), 0, true})
 			swap = len(z.pool) - 1
 		}
 	}
@@ -54,9 +135,142 @@ func (z *BufferPool) free(n int) {
 	z.pos += n
 	// move the tail over to next buffers
 	for z.tail != 0 && z.pos >= len(z.pool[z.tail-1].buf) {
-		z.pos -= len(z.pool[z.tail-1].buf)
-		newTail := z.pool[z.tail-1].next
-		z.pool[z.tail-1].active = false // after this, any thread may pick up the inactive buffer, so it can't be used anymore
+		i := z.tail - 1
+		z.pos -= len(z.pool[i].buf)
+		newTail := z.pool[i].next
+		if z.maxSize > 0 && cap(z.pool[i].buf) > z.maxSize {
+			z.pool[i].buf = nil // drop the oversized block instead of pooling it
+		} else if z.minSize > 0 {
+			bucket, _ := z.bucket(cap(z.pool[i].buf))
+			for len(z.freeBuckets) <= bucket {
+				z.freeBuckets = append(z.freeBuckets, nil)
+			}
+			z.freeBuckets[bucket] = append(z.freeBuckets[bucket], i)
+		}
+		z.pool[i].active = false // after this, any thread may pick up the inactive buffer, so it can't be used anymore
+		z.tail = newTail
+	}
+	if z.tail == 0 {
+		z.head = 0
+	}
+}
+
+// Swap implements Pool. It locks around the unexported swap so that BufferPool is safe to
+// hand off between goroutines.
+func (z *BufferPool) Swap(oldBuf []byte, size int) []byte {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.swap(oldBuf, size)
+}
+
+// Free implements Pool. It locks around the unexported free so that BufferPool is safe to
+// hand off between goroutines.
+func (z *BufferPool) Free(n int) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.free(n)
+}
+
+const (
+	syncMinSize = 1 << 10 // 1KiB
+	syncMaxSize = 1 << 20 // 1MiB; larger blocks are allocated fresh and never pooled
+	syncFactor  = 2
+)
+
+// syncBuckets holds one sync.Pool per size class (syncMinSize to syncMaxSize, doubling),
+// shared by every syncBufferPool so concurrent Lexers backed by NewSyncBufferPool recycle
+// buffers across one another instead of each other holding private memory.
+var syncBuckets = newSyncBuckets()
+
+func newSyncBuckets() []sync.Pool {
+	n := 1
+	for threshold := int64(syncMinSize); threshold < syncMaxSize; threshold *= syncFactor {
+		n++
+	}
+	buckets := make([]sync.Pool, n)
+	threshold := int64(syncMinSize)
+	for i := range buckets {
+		size := int(threshold)
+		buckets[i].New = func() interface{} { return make([]byte, 0, size) }
+		threshold *= syncFactor
+	}
+	return buckets
+}
+
+// syncBucket returns the index of the smallest syncBuckets entry whose capacity is >= size.
+func syncBucket(size int) int {
+	idx := 0
+	threshold := syncMinSize
+	for threshold < size && idx < len(syncBuckets)-1 {
+		idx++
+		threshold *= syncFactor
+	}
+	return idx
+}
+
+// syncBufferPool is a Pool that sources and recycles its buffers through syncBuckets, a
+// shared, size-bucketed sync.Pool, the way net/http/httputil.ReverseProxy shares a byte pool
+// across requests. Each syncBufferPool still keeps its own in-order retirement chain (as
+// BufferPool does), so a buffer is only handed back to the shared pool once Free confirms the
+// owning Lexer no longer needs it; it's the underlying memory, not the chain, that many
+// concurrent Lexers end up sharing. Construct one per Lexer with NewSyncBufferPool.
+type syncBufferPool struct {
+	mu sync.Mutex
+
+	pool []block
+	head int
+	tail int
+	pos  int
+}
+
+// NewSyncBufferPool returns a Pool that sources and recycles its buffers through a package-
+// wide, size-bucketed sync.Pool (1KiB to 1MiB, doubling). Construct one per Lexer, eg. for an
+// HTTP server parsing many request bodies in parallel: the Pool values are private to each
+// Lexer, but the underlying buffers are shared and reused across all of them.
+func NewSyncBufferPool() Pool {
+	return &syncBufferPool{}
+}
+
+func (z *syncBufferPool) Swap(oldBuf []byte, size int) []byte {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	var newBuf []byte
+	if size <= syncMaxSize {
+		newBuf = syncBuckets[syncBucket(size)].Get().([]byte)
+		if cap(newBuf) < size { // guard against a stale or undersized recycled entry
+			newBuf = make([]byte, 0, size)
+		}
+	} else {
+		newBuf = make([]byte, 0, size)
+	}
+
+	z.pool = append(z.pool, block{oldBuf, 0, true})
+	swap := len(z.pool) - 1
+	if z.head != 0 {
+		z.pool[z.head-1].next = swap + 1
+	}
+	z.head = swap + 1
+	if z.tail == 0 {
+		z.tail = swap + 1
+	}
+
+	return newBuf[:0]
+}
+
+func (z *syncBufferPool) Free(n int) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	z.pos += n
+	for z.tail != 0 && z.pos >= len(z.pool[z.tail-1].buf) {
+		i := z.tail - 1
+		z.pos -= len(z.pool[i].buf)
+		newTail := z.pool[i].next
+		if buf := z.pool[i].buf; cap(buf) <= syncMaxSize {
+			syncBuckets[syncBucket(cap(buf))].Put(buf[:0])
+		}
+		z.pool[i] = block{}
 		z.tail = newTail
 	}
 	if z.tail == 0 {
@@ -70,16 +284,27 @@ type Lexer struct {
 	r   io.Reader
 	err error
 
-	pool BufferPool
+	pool Pool
 
 	buf       []byte
 	start     int // index in buf
 	pos       int // index in buf
 	prevStart int
 
-	Free func(int) // this refers to pool.free, otherwise the Free function is not inlined and causes overhead
+	lastRuneSize int // size of the last rune read by ReadRune, or -1 if UnreadRune is not valid
+
+	ra        io.ReaderAt // set instead of r for a ReaderAt-backed Lexer, see NewLexerReaderAt
+	absBase   int64       // absolute stream offset of buf[0]
+	ioSize    int64       // current adaptive ReadAt request size
+	ioMax     int64       // configured ceiling for ioSize, the size passed to NewLexerReaderAt
+	posLastIO int64       // absolute offset right after the last ReadAt, to detect sequential access
+
+	Free func(int) // this refers to pool.Free, otherwise the Free function is not inlined and causes overhead
 }
 
+// minReaderAtSize is the initial (and post-jump) ReadAt request size for a ReaderAt-backed Lexer.
+const minReaderAtSize = 512
+
 // NewLexer returns a new Lexer for a given io.Reader with a 4kB estimated buffer size.
 // If the io.Reader implements Bytes, that buffer is used instead.
 func NewLexer(r io.Reader) *Lexer {
@@ -87,28 +312,113 @@ func NewLexer(r io.Reader) *Lexer {
 }
 
 // NewLexerSize returns a new Lexer for a given io.Reader and estimated required buffer size.
-// If the io.Reader implements Bytes, that buffer is used instead.
+// If the io.Reader implements Bytes, that buffer is used instead. It uses a private,
+// unbounded BufferPool; use NewLexerPool to share a bounded pool across Lexers.
 func NewLexerSize(r io.Reader, size int) *Lexer {
+	return NewLexerPoolSize(r, &BufferPool{}, size)
+}
+
+// NewLexerPool returns a new Lexer for a given io.Reader with a 4kB estimated buffer size,
+// using pool to allocate and recycle its internal buffers. See NewBufferPool and
+// NewBucketedBufferPool for a pool shared across Lexers that never run concurrently, and
+// NewSyncBufferPool for Lexers that do.
+func NewLexerPool(r io.Reader, pool Pool) *Lexer {
+	return NewLexerPoolSize(r, pool, defaultBufSize)
+}
+
+// NewLexerPoolSize is like NewLexerPool but lets the estimated initial buffer size be set explicitly.
+func NewLexerPoolSize(r io.Reader, pool Pool, size int) *Lexer {
 	var z *Lexer
 	// if reader has the bytes in memory already, use that instead
 	if buffer, ok := r.(interface {
 		Bytes() []byte
 	}); ok {
 		z = &Lexer{
-			err: io.EOF,
-			buf: buffer.Bytes(),
+			err:  io.EOF,
+			buf:  buffer.Bytes(),
+			pool: pool,
 		}
 	} else {
 		z = &Lexer{
-			r:   r,
-			buf: make([]byte, 0, size),
+			r:    r,
+			buf:  make([]byte, 0, size),
+			pool: pool,
 		}
 		z.Peek(0)
 	}
-	z.Free = z.pool.free
+	z.lastRuneSize = -1
+	z.Free = z.pool.Free
+	return z
+}
+
+// NewLexerReaderAt returns a new Lexer for a given io.ReaderAt (eg. a file, an mmap'd blob, or
+// an S3 range-getter) and estimated required buffer size, without holding the whole input in
+// memory. It detects sequential Peek/read access and prefetches with growing ReadAt requests
+// (doubling up to size); a random jump via SeekAbs drops back to a single small ReadAt. Use
+// AbsPos to recover the absolute stream offset of the current position.
+func NewLexerReaderAt(r io.ReaderAt, size int64) *Lexer {
+	z := &Lexer{
+		ra:        r,
+		buf:       make([]byte, 0, int(size)),
+		pool:      &BufferPool{},
+		ioMax:     size,
+		ioSize:    minReaderAtSize,
+		posLastIO: -1,
+	}
+	z.lastRuneSize = -1
+	z.Free = z.pool.Free
+	z.Peek(0)
 	return z
 }
 
+// SeekAbs discards the buffered data and repositions a ReaderAt-backed Lexer to the given
+// absolute offset in the stream, issuing a single small ReadAt right away instead of
+// continuing the sequential prefetch. It panics if the Lexer was not created with
+// NewLexerReaderAt. It is named SeekAbs, rather than Seek, because it takes an absolute stream
+// offset and carries no whence argument, unlike io.Seeker.
+func (z *Lexer) SeekAbs(offset int64) {
+	if z.ra == nil {
+		panic("buffer: SeekAbs requires a Lexer created with NewLexerReaderAt")
+	}
+	z.buf = z.buf[:0]
+	z.start, z.pos, z.prevStart = 0, 0, 0
+	z.lastRuneSize = -1
+	z.absBase = offset
+	z.posLastIO = -1 // force the next readAt to treat this as a random jump
+	z.err = nil
+	z.Peek(0)
+}
+
+// AbsPos returns the absolute offset in the input stream that corresponds to the current
+// position, tracked from the start of the stream (or the last SeekAbs).
+func (z *Lexer) AbsPos() int64 {
+	return z.absBase + int64(z.pos)
+}
+
+// readAt fills p starting at the absolute offset, growing the requested amount while access
+// stays sequential (contiguous with the previous ReadAt) and falling back to a small request
+// after a random jump.
+func (z *Lexer) readAt(p []byte, offset int64) (int, error) {
+	if offset == z.posLastIO {
+		if z.ioSize < z.ioMax {
+			z.ioSize *= 2
+			if z.ioSize > z.ioMax {
+				z.ioSize = z.ioMax
+			}
+		}
+	} else { // random jump: fetch conservatively again
+		z.ioSize = minReaderAtSize
+	}
+
+	n := len(p)
+	if int64(n) > z.ioSize {
+		n = int(z.ioSize)
+	}
+	read, err := z.ra.ReadAt(p[:n], offset)
+	z.posLastIO = offset + int64(read)
+	return read, err
+}
+
 func (z *Lexer) read(pos int) byte {
 	if z.err != nil {
 		return 0
@@ -121,12 +431,33 @@ func (z *Lexer) read(pos int) byte {
 		c = 2*c + p
 	}
 	d := len(z.buf) - z.start
-	buf := z.pool.swap(z.buf[:z.start], c)
+	nextOffset := z.absBase + int64(len(z.buf))
+	buf := z.pool.Swap(z.buf[:z.start], c)
 	copy(buf[:d], z.buf[z.start:]) // copy the left-overs (unfinished token) from the old buffer
+	z.absBase += int64(z.start)
 
-	// read in new data for the rest of the buffer
+	// read in new data for the rest of the buffer. A single ReadAt (throttled by readAt's
+	// sequential prefetch logic) or Read (which io.Reader permits to return short with no
+	// error) may not cover p, so keep requesting until p is covered, the buffer fills, or
+	// EOF/an error is hit.
 	var n int
-	n, z.err = z.r.Read(buf[d:cap(buf)])
+	for d+n <= p && d+n < cap(buf) {
+		var m int
+		var err error
+		if z.ra != nil {
+			m, err = z.readAt(buf[d+n:cap(buf)], nextOffset+int64(n))
+		} else {
+			m, err = z.r.Read(buf[d+n : cap(buf)])
+		}
+		n += m
+		if err != nil {
+			z.err = err
+			break
+		}
+		if m == 0 {
+			break
+		}
+	}
 	pos -= z.start
 	z.pos -= z.start
 	z.start, z.buf = 0, buf[:d+n]
@@ -136,6 +467,12 @@ func (z *Lexer) read(pos int) byte {
 		}
 		return 0
 	}
+	if pos >= len(z.buf) { // requested position wasn't reached before EOF/an error
+		if z.err == nil {
+			z.err = io.EOF
+		}
+		return 0
+	}
 	return z.buf[pos]
 }
 
@@ -172,9 +509,38 @@ func (z *Lexer) PeekRune(pos int) (rune, int) {
 	}
 }
 
+// ReadRune reads and returns a single UTF-8 encoded rune starting at the current position and
+// advances past it, implementing io.RuneReader. Invalid UTF-8 encodings return utf8.RuneError
+// with a width of 1, matching bufio.Reader.ReadRune.
+func (z *Lexer) ReadRune() (rune, int, error) {
+	if len(z.buf)-z.pos < utf8.UTFMax {
+		z.read(z.pos + utf8.UTFMax - 1)
+	}
+	if z.pos >= len(z.buf) {
+		z.lastRuneSize = -1
+		return 0, 0, z.Err()
+	}
+	r, n := utf8.DecodeRune(z.buf[z.pos:])
+	z.pos += n
+	z.lastRuneSize = n
+	return r, n, nil
+}
+
+// UnreadRune unreads the last rune read by ReadRune, implementing io.RuneScanner. It returns an
+// error if the preceding call was not a successful ReadRune.
+func (z *Lexer) UnreadRune() error {
+	if z.lastRuneSize < 0 {
+		return errUnreadRune
+	}
+	z.pos -= z.lastRuneSize
+	z.lastRuneSize = -1
+	return nil
+}
+
 // Move advances the position.
 func (z *Lexer) Move(n int) {
 	z.pos += n
+	z.lastRuneSize = -1
 }
 
 // Pos returns a mark to which can be rewinded.
@@ -185,6 +551,7 @@ func (z *Lexer) Pos() int {
 // Rewind rewinds the position to the given position.
 func (z *Lexer) Rewind(pos int) {
 	z.pos = z.start + pos
+	z.lastRuneSize = -1
 }
 
 // Lexeme returns the bytes of the current selection.
@@ -196,6 +563,7 @@ func (z *Lexer) Lexeme() []byte {
 func (z *Lexer) Shift() []byte {
 	b := z.buf[z.start:z.pos]
 	z.start = z.pos
+	z.lastRuneSize = -1
 	return b
 }
 
@@ -209,4 +577,67 @@ func (z *Lexer) ShiftLen() int {
 // Skip collapses the position to the end of the selection.
 func (z *Lexer) Skip() {
 	z.start = z.pos
+	z.lastRuneSize = -1
+}
+
+// maxVarintLen is the maximum number of bytes a 64-bit varint can occupy, as in encoding/binary.
+const maxVarintLen = 10
+
+// ReadUvarint reads an unsigned LEB128-encoded varint (as in encoding/binary) relative to the
+// end position and advances past it. It decodes directly out of buf, only falling back to
+// Peek byte-by-byte near the true end of the input. It returns the decoded value and the
+// number of bytes consumed, or (0, 0) if the input contains a malformed varint that doesn't
+// terminate within maxVarintLen bytes, where encoding/binary.Uvarint would instead return a
+// negative count; in that case the position is left unchanged, so the 0 accurately
+// reflects that nothing was consumed. Peek returns zero when an error has occurred, Err
+// returns the error.
+func (z *Lexer) ReadUvarint() (uint64, int) {
+	if len(z.buf)-z.pos < maxVarintLen {
+		z.read(z.pos + maxVarintLen - 1)
+	}
+	if len(z.buf)-z.pos >= maxVarintLen {
+		var x uint64
+		for i := 0; i < maxVarintLen; i++ {
+			b := z.buf[z.pos+i]
+			if b < 0x80 {
+				n := i + 1
+				z.pos += n
+				z.lastRuneSize = -1
+				return x | uint64(b)<<uint(7*i), n
+			}
+			x |= uint64(b&0x7f) << uint(7*i)
+		}
+		// malformed varint that didn't terminate within maxVarintLen bytes; leave the
+		// position unchanged so (0, 0) accurately reflects that nothing was consumed
+		return 0, 0
+	}
+
+	// true EOF is near, fall back to per-byte Peek
+	var x uint64
+	for i := 0; i < maxVarintLen; i++ {
+		b := z.Peek(i)
+		if z.pos+i >= len(z.buf) { // Peek hit EOF before returning a byte
+			return 0, 0
+		}
+		if b < 0x80 {
+			n := i + 1
+			z.Move(n)
+			return x | uint64(b)<<uint(7*i), n
+		}
+		x |= uint64(b&0x7f) << uint(7*i)
+	}
+	// malformed varint that didn't terminate within maxVarintLen bytes; leave the position
+	// unchanged so (0, 0) accurately reflects that nothing was consumed
+	return 0, 0
+}
+
+// ReadVarint reads a signed LEB128-encoded varint (as in encoding/binary, zigzag-decoded) and
+// advances past it. See ReadUvarint for the decoding strategy and error behavior.
+func (z *Lexer) ReadVarint() (int64, int) {
+	ux, n := z.ReadUvarint()
+	x := int64(ux >> 1)
+	if ux&1 != 0 {
+		x = ^x
+	}
+	return x, n
 }
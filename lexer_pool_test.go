@@ -0,0 +1,58 @@
+package buffer
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestSyncBufferPoolConcurrent runs many Lexers, each backed by its own NewSyncBufferPool, on
+// separate goroutines at once and checks every one reads all bytes of its input. Run with
+// -race to verify the shared sync.Pool buckets aren't corrupted by concurrent access.
+func TestSyncBufferPoolConcurrent(t *testing.T) {
+	var wg sync.WaitGroup
+	for g := 0; g < 32; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			data := bytes.Repeat([]byte(fmt.Sprintf("token%d ", g)), 500)
+			z := NewLexerPool(bytes.NewReader(data), NewSyncBufferPool())
+			n := 0
+			for {
+				z.Peek(0)
+				if z.Err() != nil {
+					break
+				}
+				z.Move(1)
+				z.Skip()
+				z.Free(z.ShiftLen())
+				n++
+			}
+			if n != len(data) {
+				t.Errorf("goroutine %d: read %d bytes, want %d", g, n, len(data))
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+// BenchmarkSyncBufferPool measures the cost of lexing many inputs concurrently while sharing
+// one family of sync.Pool buckets.
+func BenchmarkSyncBufferPool(b *testing.B) {
+	data := bytes.Repeat([]byte("hello world "), 1000)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			z := NewLexerPool(bytes.NewReader(data), NewSyncBufferPool())
+			for {
+				z.Peek(0)
+				if z.Err() != nil {
+					break
+				}
+				z.Move(1)
+				z.Skip()
+				z.Free(z.ShiftLen())
+			}
+		}
+	})
+}
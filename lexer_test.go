@@ -0,0 +1,317 @@
+package buffer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"unicode/utf8"
+)
+
+// TestReadUvarintFastPath checks the buf-direct decode path against encoding/binary's own
+// encoder for a range of values, encoding to 1, 2, 3, 9 and maxVarintLen (10) bytes.
+func TestReadUvarintFastPath(t *testing.T) {
+	values := []uint64{0, 1, 127, 128, 300, 1 << 20, 1<<63 - 1, 1 << 63, ^uint64(0)}
+	var data []byte
+	for _, v := range values {
+		buf := make([]byte, binary.MaxVarintLen64)
+		n := binary.PutUvarint(buf, v)
+		data = append(data, buf[:n]...)
+	}
+
+	z := NewLexer(bytes.NewReader(data))
+	for _, want := range values {
+		got, n := z.ReadUvarint()
+		if got != want {
+			t.Errorf("ReadUvarint() = %d, want %d", got, want)
+		}
+		if n == 0 {
+			t.Fatalf("ReadUvarint() returned n=0 for a well-formed value %d", want)
+		}
+		z.Free(z.ShiftLen())
+	}
+	if z.Err() != nil {
+		t.Errorf("Err() = %v, want nil", z.Err())
+	}
+}
+
+// TestReadUvarintEOFFallback exercises the per-byte Peek fallback near true EOF, both for a
+// value that fits and for one truncated mid-encoding.
+func TestReadUvarintEOFFallback(t *testing.T) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, 300)
+	z := NewLexer(bytes.NewReader(buf[:n]))
+	got, got_n := z.ReadUvarint()
+	if got != 300 || got_n != n {
+		t.Errorf("ReadUvarint() = (%d, %d), want (300, %d)", got, got_n, n)
+	}
+
+	// truncated: continuation bit set on the last available byte
+	z = NewLexer(bytes.NewReader(buf[:n-1]))
+	if _, got_n := z.ReadUvarint(); got_n != 0 {
+		t.Errorf("ReadUvarint() on truncated input returned n=%d, want 0", got_n)
+	}
+}
+
+// TestReadUvarintMalformed checks that a 10-byte sequence whose continuation bit never clears
+// is reported as malformed (0, 0) rather than as a valid 10-byte value, and that the position
+// is left unchanged so the 0 count accurately reflects that nothing was consumed.
+func TestReadUvarintMalformed(t *testing.T) {
+	data := bytes.Repeat([]byte{0x80}, maxVarintLen)
+	z := NewLexer(bytes.NewReader(data))
+	pos := z.Pos()
+	x, n := z.ReadUvarint()
+	if n != 0 || x != 0 {
+		t.Errorf("ReadUvarint() on malformed input = (%d, %d), want (0, 0)", x, n)
+	}
+	if z.Pos() != pos {
+		t.Errorf("Pos() after malformed ReadUvarint = %d, want unchanged %d", z.Pos(), pos)
+	}
+}
+
+// TestReadUvarintInvalidatesUnreadRune checks that a fast-path ReadUvarint, which advances
+// z.pos directly rather than through Move, still invalidates a pending UnreadRune.
+func TestReadUvarintInvalidatesUnreadRune(t *testing.T) {
+	buf := make([]byte, 1+binary.MaxVarintLen64)
+	buf[0] = 'A'
+	n := binary.PutUvarint(buf[1:], 5)
+	data := append(buf[:1+n], bytes.Repeat([]byte("x"), 30)...)
+
+	z := NewLexer(bytes.NewReader(data))
+	if _, _, err := z.ReadRune(); err != nil {
+		t.Fatalf("ReadRune() error = %v", err)
+	}
+	if _, n := z.ReadUvarint(); n == 0 {
+		t.Fatalf("ReadUvarint() returned n=0")
+	}
+	if err := z.UnreadRune(); err != errUnreadRune {
+		t.Errorf("UnreadRune() after an intervening ReadUvarint = %v, want errUnreadRune", err)
+	}
+}
+
+// TestReadRuneUnreadRune checks the basic read/unread round trip, including multi-byte runes.
+func TestReadRuneUnreadRune(t *testing.T) {
+	z := NewLexer(bytes.NewReader([]byte("aé中")))
+	for _, want := range []rune{'a', 'é', '中'} {
+		r, n, err := z.ReadRune()
+		if err != nil {
+			t.Fatalf("ReadRune() error = %v", err)
+		}
+		if r != want {
+			t.Errorf("ReadRune() = %q, want %q", r, want)
+		}
+		if err := z.UnreadRune(); err != nil {
+			t.Fatalf("UnreadRune() error = %v", err)
+		}
+		r2, n2, err := z.ReadRune()
+		if err != nil || r2 != want || n2 != n {
+			t.Errorf("re-ReadRune() = (%q, %d, %v), want (%q, %d, nil)", r2, n2, err, want, n)
+		}
+	}
+}
+
+// TestUnreadRuneWithoutReadRune checks that UnreadRune errors when there was no preceding
+// successful ReadRune, and that it stays invalid after an intervening position change.
+func TestUnreadRuneWithoutReadRune(t *testing.T) {
+	z := NewLexer(bytes.NewReader([]byte("ab")))
+	if err := z.UnreadRune(); err != errUnreadRune {
+		t.Errorf("UnreadRune() with no prior ReadRune = %v, want errUnreadRune", err)
+	}
+
+	if _, _, err := z.ReadRune(); err != nil {
+		t.Fatalf("ReadRune() error = %v", err)
+	}
+	z.Move(0) // any position-mutating call invalidates the pending unread
+	if err := z.UnreadRune(); err != errUnreadRune {
+		t.Errorf("UnreadRune() after Move = %v, want errUnreadRune", err)
+	}
+}
+
+// TestReadRuneInvalidUTF8 checks that an invalid UTF-8 byte is reported as utf8.RuneError with
+// a width of 1, matching bufio.Reader.ReadRune.
+func TestReadRuneInvalidUTF8(t *testing.T) {
+	z := NewLexer(bytes.NewReader([]byte{0xff, 'a'}))
+	r, n, err := z.ReadRune()
+	if err != nil || r != utf8.RuneError || n != 1 {
+		t.Errorf("ReadRune() on invalid UTF-8 = (%q, %d, %v), want (RuneError, 1, nil)", r, n, err)
+	}
+}
+
+// TestReadRuneEOF checks that ReadRune returns io.EOF (via Err) once the input is exhausted.
+func TestReadRuneEOF(t *testing.T) {
+	z := NewLexer(bytes.NewReader([]byte("a")))
+	if _, _, err := z.ReadRune(); err != nil {
+		t.Fatalf("ReadRune() error = %v", err)
+	}
+	if _, _, err := z.ReadRune(); err != z.Err() || err == nil {
+		t.Errorf("ReadRune() at EOF = %v, want %v", err, z.Err())
+	}
+}
+
+// TestBufferPoolOversizedDropped checks that NewBufferPool never recycles a block larger than
+// maxSize: once a fully-consumed oversized block is retired via Swap+Free, it must not come
+// back out of a later Swap.
+func TestBufferPoolOversizedDropped(t *testing.T) {
+	p := NewBufferPool(100)
+	buf := p.Swap(nil, 200)
+	if cap(buf) < 200 {
+		t.Fatalf("Swap(nil, 200) cap = %d, want >= 200", cap(buf))
+	}
+	buf = buf[:200] // pretend the buffer is fully in use, as a Lexer would leave it
+	p.Swap(buf, 50) // retire buf for potential recycling
+	p.Free(200)     // confirm all 200 bytes consumed; buf is oversized, so it must be dropped
+
+	for i := range buf {
+		buf[i] = 1
+	}
+	reused := p.Swap(nil, 50)
+	reused = reused[:cap(reused)]
+	if &reused[0] == &buf[0] {
+		t.Errorf("Swap(nil, 50) reused the oversized dropped block")
+	}
+}
+
+// TestBucketSelection checks that bucket picks the smallest size class that fits.
+func TestBucketSelection(t *testing.T) {
+	p := NewBucketedBufferPool(1024, 1<<20, 2)
+	tests := []struct {
+		size          int
+		wantIdx       int
+		wantThreshold int
+	}{
+		{1, 0, 1024},
+		{1024, 0, 1024},
+		{1025, 1, 2048},
+		{4096, 2, 4096},
+		{4097, 3, 8192},
+	}
+	for _, tt := range tests {
+		idx, threshold := p.bucket(tt.size)
+		if idx != tt.wantIdx || threshold != tt.wantThreshold {
+			t.Errorf("bucket(%d) = (%d, %d), want (%d, %d)", tt.size, idx, threshold, tt.wantIdx, tt.wantThreshold)
+		}
+	}
+}
+
+// TestBucketedBufferPoolReuse checks that a block freed by a bucketed pool is handed back out
+// by a later Swap asking for a size in the same bucket.
+func TestBucketedBufferPoolReuse(t *testing.T) {
+	p := NewBucketedBufferPool(1024, 1<<20, 2)
+	buf := p.Swap(nil, 1500) // bucket threshold 2048
+	buf = buf[:1500]         // pretend the buffer is fully in use
+	p.Swap(buf, 300)         // retire buf for potential recycling
+	p.Free(1500)             // confirm all 1500 bytes consumed
+
+	reused := p.Swap(nil, 1200) // same bucket (threshold 2048)
+	if cap(reused) != cap(buf) || &reused[:1][0] != &buf[0] {
+		t.Errorf("Swap(nil, 1200) cap = %d, want the retired block with cap %d handed back", cap(reused), cap(buf))
+	}
+}
+
+// TestLexerReaderAtFarPeek peeks far ahead of the initial, throttled ReadAt request in one
+// call, a regression test for a panic when readAt's throttled fetch didn't cover the requested
+// position.
+func TestLexerReaderAtFarPeek(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000) // 10000 bytes
+	z := NewLexerReaderAt(bytes.NewReader(data), 4096)
+	if b := z.Peek(2000); b != data[2000] {
+		t.Errorf("Peek(2000) = %q, want %q", b, data[2000])
+	}
+	if err := z.Err(); err != nil {
+		t.Errorf("Err() = %v, want nil", err)
+	}
+}
+
+// TestLexerReaderAtSequentialPrefetch checks that ioSize grows while access stays sequential.
+func TestLexerReaderAtSequentialPrefetch(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 100000)
+	z := NewLexerReaderAt(bytes.NewReader(data), 1<<20)
+	if z.ioSize != minReaderAtSize {
+		t.Fatalf("initial ioSize = %d, want %d", z.ioSize, minReaderAtSize)
+	}
+	prev := z.ioSize
+	grew := false
+	for i := 0; i < 5000; i++ {
+		z.Peek(0)
+		if z.Err() != nil {
+			break
+		}
+		z.Move(1)
+		z.Skip()
+		z.Free(z.ShiftLen())
+		if z.ioSize > prev {
+			grew = true
+		}
+		prev = z.ioSize
+	}
+	if !grew {
+		t.Errorf("ioSize never grew past %d during sequential access", minReaderAtSize)
+	}
+}
+
+// TestLexerReaderAtSeekAbs checks that SeekAbs repositions AbsPos and resets the prefetch size
+// for the random jump, and that SeekAbs on a non-ReaderAt Lexer panics.
+func TestLexerReaderAtSeekAbs(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	z := NewLexerReaderAt(bytes.NewReader(data), 4096)
+	z.Peek(0)
+	z.Move(500)
+	z.Skip()
+
+	z.SeekAbs(3000)
+	if got := z.AbsPos(); got != 3000 {
+		t.Errorf("AbsPos() after SeekAbs(3000) = %d, want 3000", got)
+	}
+	if z.ioSize != minReaderAtSize {
+		t.Errorf("ioSize after SeekAbs = %d, want reset to %d", z.ioSize, minReaderAtSize)
+	}
+	if b := z.Peek(0); b != data[3000] {
+		t.Errorf("Peek(0) after SeekAbs(3000) = %q, want %q", b, data[3000])
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("SeekAbs on a non-ReaderAt Lexer did not panic")
+		}
+	}()
+	NewLexer(bytes.NewReader(data)).SeekAbs(0)
+}
+
+// shortReader is an io.Reader that always returns at most chunkSize bytes per call with no
+// error, a legitimate "short read" per the io.Reader contract (common for sockets and pipes).
+type shortReader struct {
+	data      []byte
+	chunkSize int
+}
+
+func (r *shortReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := r.chunkSize
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(r.data) {
+		n = len(r.data)
+	}
+	copy(p, r.data[:n])
+	r.data = r.data[n:]
+	return n, nil
+}
+
+// TestLexerShortReadNotTreatedAsEOF checks that a legitimate short read (fewer bytes than
+// requested, no error) doesn't cause a far-ahead Peek to be misreported as EOF: read() must
+// keep calling Read until the requested position is covered or a real error/EOF occurs.
+func TestLexerShortReadNotTreatedAsEOF(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 3000) // 30000 bytes
+	r := &shortReader{data: append([]byte(nil), data...), chunkSize: 10}
+	z := NewLexer(r)
+
+	if b := z.Peek(5000); b != data[5000] {
+		t.Errorf("Peek(5000) = %q, want %q", b, data[5000])
+	}
+	if err := z.Err(); err != nil {
+		t.Errorf("Err() = %v, want nil; a short read must not be mistaken for EOF", err)
+	}
+}